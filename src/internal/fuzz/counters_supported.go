@@ -0,0 +1,21 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build libfuzzer
+// +build libfuzzer
+
+package fuzz
+
+import _ "unsafe" // for go:linkname
+
+// _counterTab is the 8-bit edge counter table maintained by the compiler's
+// coverage instrumentation, enabled by building with -d=libfuzzer. Each
+// byte counts executions of one basic block edge, saturating at 255.
+//
+// workerServer aliases this table onto the counters region of shared
+// memory (see (*workerServer).aliasCounters) so that the coordinator can
+// read counter growth directly, without a copy per fuzz call.
+//
+//go:linkname _counterTab runtime.coverCounters
+var _counterTab []byte
@@ -0,0 +1,13 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !libfuzzer
+// +build !libfuzzer
+
+package fuzz
+
+// _counterTab is empty on builds without coverage instrumentation: there's
+// no counter table for coverage to report, and workerServer leaves the
+// counters region of shared memory unused.
+var _counterTab []byte
@@ -0,0 +1,18 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+// coverage returns the process's coverage counter table: one byte per edge
+// instrumented by the compiler's -d=libfuzzer coverage instrumentation in
+// the fuzz target and the packages it imports, incremented (and saturated
+// at 255) as the program runs.
+//
+// Its length is fixed for the lifetime of the process, so len(coverage())
+// can be passed as the counterLen of sharedMemTempFile to size the counters
+// region of a sharedMem; see sharedMemSize and (*sharedMem).counters.
+// On a build without coverage instrumentation, coverage returns nil.
+func coverage() []byte {
+	return _counterTab
+}
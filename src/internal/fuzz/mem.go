@@ -6,14 +6,17 @@ package fuzz
 
 import (
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"unsafe"
 )
 
 // sharedMem manages access to a region of virtual memory mapped from a file,
-// shared between multiple processes. The region includes space for a header and
-// a value of variable length.
+// shared between multiple processes. The region includes space for a header,
+// a fixed-size coverage counter table, and a value of variable length, in
+// that order.
 //
 // When fuzzing, the coordinator creates a sharedMem from a temporary file for
 // each worker. This buffer is used to pass values to fuzz between processes.
@@ -37,22 +40,78 @@ type sharedMem struct {
 	sys sharedMemSys
 }
 
+// sharedMemMagic identifies a sharedMem's header as belonging to this
+// version of the fuzz package. sharedMemVersion is bumped whenever the
+// layout of sharedMemHeader changes; a worker that maps a file written by a
+// coordinator built with a different version (or vice versa) checks these
+// fields and fails cleanly instead of misinterpreting the counters region.
+const (
+	sharedMemMagic   uint32 = 0x7a677a66 // "zgzf"
+	sharedMemVersion uint32 = 1
+)
+
 // sharedMemHeader stores metadata in shared memory.
 type sharedMemHeader struct {
+	magic   uint32
+	version uint32
+
 	length int
+
+	// counterLen is the number of bytes reserved for the 8-bit coverage
+	// counter table, which sits immediately after the header (and before
+	// the value) at a fixed offset that resize never moves. See
+	// (*sharedMem).counters.
+	counterLen int
+
+	// seq is a sequence number bumped by beginWrite and endWrite, à la
+	// seqlock: odd means a write to the value is in progress, even means
+	// the value is stable. recover uses it, together with crc32, to tell
+	// whether the value reflects a write that completed before whichever
+	// process was writing it died.
+	seq uint64
+
+	// writerPID is the process ID that last called beginWrite, recorded so
+	// recover can report which worker a crash reproducer came from.
+	writerPID int32
+
+	// crc32 is the CRC-32 checksum (IEEE polynomial) of the first length
+	// bytes of the value, written by endWrite once the copy into it has
+	// completed.
+	crc32 uint32
 }
 
 // sharedMemSize returns the size needed for a shared memory buffer that can
-// contain values of the given size.
-func sharedMemSize(valueSize int) int {
-	// TODO(jayconrod): set a reasonable maximum size per platform.
-	return int(unsafe.Sizeof(sharedMemHeader{})) + valueSize
+// contain a value of the given size plus a coverage counter table of
+// counterLen bytes. It returns an error if that size would exceed
+// sharedMemMaxSize, the per-platform limit on how large a shared memory
+// buffer is allowed to grow; without this limit, a mutator that keeps
+// extending its input could run the coordinator out of address space.
+func sharedMemSize(valueSize, counterLen int) (int, error) {
+	total := int(unsafe.Sizeof(sharedMemHeader{})) + valueSize + counterLen
+	if total > sharedMemMaxSize {
+		return 0, fmt.Errorf("shared memory size %d exceeds maximum of %d", total, sharedMemMaxSize)
+	}
+	return total, nil
+}
+
+// checkHeader verifies that the region was written by this version of the
+// fuzz package. It's called after mapping a file created by another
+// process (for example, when a worker inherits a coordinator's shared
+// memory), so that a mismatched build is rejected instead of silently
+// misreading the value or counters region.
+func (m *sharedMem) checkHeader() error {
+	h := m.header()
+	if h.magic != sharedMemMagic || h.version != sharedMemVersion {
+		return fmt.Errorf("shared memory header magic/version mismatch: got %#x/%d, want %#x/%d", h.magic, h.version, sharedMemMagic, sharedMemVersion)
+	}
+	return nil
 }
 
-// sharedMemTempFile creates a new temporary file large enough to hold a value
-// of the given size, then maps it into memory. The file will be removed when
-// the Close method is called.
-func sharedMemTempFile(valueSize int) (m *sharedMem, err error) {
+// sharedMemTempFile creates a new temporary file large enough to hold a
+// value of the given size plus a coverage counter table of counterLen
+// bytes, then maps it into memory. The file will be removed when the Close
+// method is called.
+func sharedMemTempFile(valueSize, counterLen int) (m *sharedMem, err error) {
 	// Create a temporary file.
 	f, err := ioutil.TempFile("", "fuzz-*")
 	if err != nil {
@@ -66,14 +125,25 @@ func sharedMemTempFile(valueSize int) (m *sharedMem, err error) {
 	}()
 
 	// Resize it to the correct size.
-	totalSize := sharedMemSize(valueSize)
+	totalSize, err := sharedMemSize(valueSize, counterLen)
+	if err != nil {
+		return nil, err
+	}
 	if err := f.Truncate(int64(totalSize)); err != nil {
 		return nil, err
 	}
 
 	// Map the file into memory.
 	removeOnClose := true
-	return sharedMemMapFile(f, totalSize, removeOnClose)
+	m, err = sharedMemMapFile(f, totalSize, removeOnClose)
+	if err != nil {
+		return nil, err
+	}
+	h := m.header()
+	h.magic = sharedMemMagic
+	h.version = sharedMemVersion
+	h.counterLen = counterLen
+	return m, nil
 }
 
 // header returns a pointer to metadata within the shared memory region.
@@ -81,27 +151,150 @@ func (m *sharedMem) header() *sharedMemHeader {
 	return (*sharedMemHeader)(unsafe.Pointer(&m.region[0]))
 }
 
+// valueOffset returns the offset of the value region within m.region. The
+// counters region sits between the header and the value, at a fixed offset
+// right after the header, so that its location doesn't depend on the
+// overall size of the mapping: resize only ever grows the value region
+// into the tail of the file, so the counters region never moves relative
+// to the header, and a remap never strands it behind stale data.
+func (m *sharedMem) valueOffset() int {
+	return int(unsafe.Sizeof(sharedMemHeader{})) + m.header().counterLen
+}
+
+// valueCap returns the number of bytes reserved for the value, not counting
+// the header or the counters region that precedes it.
+func (m *sharedMem) valueCap() int {
+	return len(m.region) - m.valueOffset()
+}
+
 // value returns the value currently stored in shared memory. The returned slice
-// points to shared memory; it is not a copy.
+// points to shared memory; it is not a copy. Its capacity is bounded to the
+// value region, so appending to it cannot spill past the end of the mapping.
 func (m *sharedMem) value() []byte {
 	length := m.header().length
-	valueOffset := int(unsafe.Sizeof(sharedMemHeader{}))
-	return m.region[valueOffset : valueOffset+length]
+	valueOffset := m.valueOffset()
+	valueCap := m.valueCap()
+	return m.region[valueOffset : valueOffset+length : valueOffset+valueCap]
+}
+
+// counters returns the coverage counter table stored in shared memory. The
+// returned slice points to shared memory; it is not a copy. It has length
+// and capacity equal to the counterLen passed to sharedMemTempFile, which
+// is normally len(_counterTab); see counters_supported.go. Its offset is
+// fixed right after the header, so growing the value with resize never
+// moves it and never requires relocating its contents.
+func (m *sharedMem) counters() []byte {
+	counterLen := m.header().counterLen
+	counterOffset := int(unsafe.Sizeof(sharedMemHeader{}))
+	return m.region[counterOffset : counterOffset+counterLen : counterOffset+counterLen]
 }
 
 // setValue copies the data in b into the shared memory buffer and sets
 // the length. len(b) must be less than or equal to the capacity of the buffer
-// (as returned by cap(m.value())).
+// (as returned by cap(m.value())). The write is framed with beginWrite and
+// endWrite, so a process that crashes or is killed partway through setValue
+// leaves recover able to tell that the value is torn.
 func (m *sharedMem) setValue(b []byte) {
 	v := m.value()
 	if len(b) > cap(v) {
 		panic(fmt.Sprintf("value length %d larger than shared memory capacity %d", len(b), cap(v)))
 	}
+	m.beginWrite()
 	m.header().length = len(b)
 	copy(v[:cap(v)], b)
+	m.endWrite(len(b))
+}
+
+// beginWrite marks the start of a write to the value. It must be paired
+// with a call to endWrite once the new value has been copied in. Between
+// the two calls, seq is odd, so recover can tell a reader that the value is
+// mid-write and not yet trustworthy.
+func (m *sharedMem) beginWrite() {
+	h := m.header()
+	h.writerPID = int32(os.Getpid())
+	atomic.AddUint64(&h.seq, 1)
+}
+
+// endWrite marks the end of a write begun with beginWrite. n is the number
+// of bytes just written to the value (its new length). endWrite records a
+// CRC-32 of those bytes and makes seq even again, marking the value stable.
+func (m *sharedMem) endWrite(n int) {
+	h := m.header()
+	valueOffset := m.valueOffset()
+	h.crc32 = crc32.ChecksumIEEE(m.region[valueOffset : valueOffset+n])
+	atomic.AddUint64(&h.seq, 1)
+}
+
+// recover reports whether the value currently stored in shared memory is
+// trustworthy, and returns a copy of it if so. The coordinator calls this
+// after a worker dies unexpectedly (a crash or an OS kill) to decide
+// whether the value reflects the input that caused the death, as opposed
+// to a partially written next input that happened to be in flight.
+//
+// recover considers the value trustworthy only if seq is even (no write
+// was in progress) and the stored crc32 matches the value's contents. If
+// it returns ok == false, the coordinator should fall back to the last
+// input it independently knows was written completely, rather than
+// trusting shared memory.
+func (m *sharedMem) recover() (value []byte, writerPID int32, ok bool) {
+	h := m.header()
+	if atomic.LoadUint64(&h.seq)%2 != 0 {
+		return nil, h.writerPID, false
+	}
+	v := m.value()
+	if crc32.ChecksumIEEE(v) != h.crc32 {
+		return nil, h.writerPID, false
+	}
+	cp := make([]byte, len(v))
+	copy(cp, v)
+	return cp, h.writerPID, true
 }
 
-// TODO(jayconrod): add method to resize the buffer. We'll need that when the
-// mutator can increase input length. Only the coordinator will be able to
-// do it, since we'll need to send a message to the worker telling it to
-// remap the file.
+// setValueLen ensures the buffer is large enough to hold a value of the
+// given size, growing the underlying mapping with resize if needed, then
+// updates the stored length to n. beginWrite is only called once resize has
+// succeeded, so a failed resize (for example, hitting sharedMemMaxSize)
+// leaves seq exactly as it was, rather than stranding it on an odd value
+// that would make recover distrust an otherwise-good, already-written
+// value forever after. On success, the caller must write n bytes into
+// m.value() and then call endWrite(n) to make the new value visible to
+// recover; until endWrite is called, seq stays odd.
+func (m *sharedMem) setValueLen(n int) error {
+	if n > cap(m.value()) {
+		if err := m.resize(n); err != nil {
+			return err
+		}
+	}
+	m.beginWrite()
+	m.header().length = n
+	return nil
+}
+
+// resize grows the shared memory region so that the value can hold at
+// least newCap bytes. Only the coordinator calls resize directly: the file
+// is backing storage shared with a worker process, so after resizing, the
+// coordinator must tell the worker (see workerClient.resizeMem in
+// worker.go) to unmap and remap the file before the worker's next fuzz
+// call.
+//
+// resize does nothing if the region is already large enough. Growing the
+// file with Truncate only adds zero bytes past the old end; the header and
+// value already written stay where they are and need no restoring once
+// the region is remapped at the new size.
+func (m *sharedMem) resize(newCap int) error {
+	counterLen := m.header().counterLen
+	newSize, err := sharedMemSize(newCap, counterLen)
+	if err != nil {
+		return err
+	}
+	if newSize <= len(m.region) {
+		return nil
+	}
+	if err := m.f.Truncate(int64(newSize)); err != nil {
+		return fmt.Errorf("truncating shared memory file: %w", err)
+	}
+	if err := m.unmapRegion(); err != nil {
+		return err
+	}
+	return m.mapRegion(newSize)
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSharedMemSetValueRecover(t *testing.T) {
+	m, err := sharedMemTempFile(16, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	want := []byte("hello")
+	m.setValue(want)
+
+	got, _, ok := m.recover()
+	if !ok {
+		t.Fatal("recover reported ok = false for a value that was written completely")
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("recover returned %q, want %q", got, want)
+	}
+}
+
+func TestSharedMemRecoverDetectsTornWrite(t *testing.T) {
+	m, err := sharedMemTempFile(16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.setValue([]byte("hello"))
+	m.beginWrite() // simulate a writer that died before calling endWrite
+
+	if _, _, ok := m.recover(); ok {
+		t.Error("recover reported ok = true for a value with a write in progress")
+	}
+}
+
+func TestSharedMemResizePreservesValueAndCounters(t *testing.T) {
+	m, err := sharedMemTempFile(4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	value := []byte("abcd")
+	m.setValue(value)
+	wantCounters := []byte{1, 2, 3, 4}
+	copy(m.counters(), wantCounters)
+
+	if err := m.resize(64); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.value(); !bytes.Equal(got, value) {
+		t.Errorf("value after resize = %q, want %q", got, value)
+	}
+	if got := m.counters(); !bytes.Equal(got, wantCounters) {
+		t.Errorf("counters after resize = %v, want %v", got, wantCounters)
+	}
+}
+
+func TestSharedMemSetValueLenFailurePreservesRecoverability(t *testing.T) {
+	m, err := sharedMemTempFile(4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	m.setValue([]byte("ok"))
+
+	if err := m.setValueLen(sharedMemMaxSize); err == nil {
+		t.Fatal("setValueLen with an oversized length unexpectedly succeeded")
+	}
+
+	if _, _, ok := m.recover(); !ok {
+		t.Error("recover reported ok = false after a failed setValueLen that never touched the stored value")
+	}
+}
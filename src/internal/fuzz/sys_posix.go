@@ -0,0 +1,73 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package fuzz
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// sharedMemMaxSize is the largest a shared memory buffer is allowed to grow.
+// It's generous enough for any corpus entry we expect to mutate into, while
+// still bounding how much address space a single worker can claim.
+const sharedMemMaxSize = 1 << 30 // 1 GiB
+
+// sharedMemSys holds OS-specific fields of sharedMem. Unix mappings don't
+// need any extra bookkeeping beyond the region itself.
+type sharedMemSys struct{}
+
+// sharedMemMapFile maps f into memory and returns a *sharedMem that
+// references it.
+func sharedMemMapFile(f *os.File, size int, removeOnClose bool) (*sharedMem, error) {
+	m := &sharedMem{f: f, removeOnClose: removeOnClose}
+	if err := m.mapRegion(size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mapRegion maps size bytes of m.f into memory and sets m.region. It's used
+// both for the initial mapping and, after resize has truncated the file to a
+// larger size, to remap it.
+func (m *sharedMem) mapRegion(size int) error {
+	region, err := syscall.Mmap(int(m.f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mapping temporary file: %w", err)
+	}
+	m.region = region
+	return nil
+}
+
+// unmapRegion unmaps m.region so that m.f can be truncated and remapped at a
+// new size.
+func (m *sharedMem) unmapRegion() error {
+	if err := syscall.Munmap(m.region); err != nil {
+		return fmt.Errorf("unmapping temporary file: %w", err)
+	}
+	m.region = nil
+	return nil
+}
+
+// Close unmaps the shared memory and closes the temporary file. If the
+// sharedMem was created with removeOnClose set, the file is also removed.
+func (m *sharedMem) Close() error {
+	if m.region == nil {
+		return nil
+	}
+	if err := m.unmapRegion(); err != nil {
+		return err
+	}
+	if err := m.f.Close(); err != nil {
+		return err
+	}
+	if m.removeOnClose {
+		return os.Remove(m.f.Name())
+	}
+	return nil
+}
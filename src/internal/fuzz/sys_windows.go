@@ -0,0 +1,90 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package fuzz
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// sharedMemMaxSize is the largest a shared memory buffer is allowed to grow.
+// It's smaller than the Unix limit since each resize recreates the file
+// mapping object for the temporary file, which is more costly on Windows.
+const sharedMemMaxSize = 1 << 28 // 256 MiB
+
+// sharedMemSys holds OS-specific fields of sharedMem. On Windows, a mapping
+// is addressed through a file mapping object whose size is fixed when it's
+// created, so resize must close and recreate mapHandle.
+type sharedMemSys struct {
+	mapHandle syscall.Handle
+}
+
+// sharedMemMapFile maps f into memory and returns a *sharedMem that
+// references it.
+func sharedMemMapFile(f *os.File, size int, removeOnClose bool) (*sharedMem, error) {
+	m := &sharedMem{f: f, removeOnClose: removeOnClose}
+	if err := m.mapRegion(size); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mapRegion creates a new file mapping object for m.f sized to size, maps a
+// view of it into memory, and sets m.region and m.sys.mapHandle. It's used
+// both for the initial mapping and, after resize has truncated the file to a
+// larger size, to recreate the mapping object at the new size.
+func (m *sharedMem) mapRegion(size int) error {
+	mapHandle, err := syscall.CreateFileMapping(
+		syscall.Handle(m.f.Fd()), nil, syscall.PAGE_READWRITE, 0, uint32(size), nil)
+	if err != nil {
+		return fmt.Errorf("creating file mapping: %w", err)
+	}
+	addr, err := syscall.MapViewOfFile(mapHandle, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		syscall.CloseHandle(mapHandle)
+		return fmt.Errorf("mapping view of file: %w", err)
+	}
+	m.sys.mapHandle = mapHandle
+	m.region = unsafe.Slice((*byte)(unsafe.Pointer(addr)), size)
+	return nil
+}
+
+// unmapRegion unmaps the current view and closes the file mapping object, so
+// that m.f can be truncated and a new mapping object created at a new size.
+func (m *sharedMem) unmapRegion() error {
+	addr := uintptr(unsafe.Pointer(&m.region[0]))
+	if err := syscall.UnmapViewOfFile(addr); err != nil {
+		return fmt.Errorf("unmapping view of file: %w", err)
+	}
+	if err := syscall.CloseHandle(m.sys.mapHandle); err != nil {
+		return fmt.Errorf("closing file mapping: %w", err)
+	}
+	m.sys.mapHandle = 0
+	m.region = nil
+	return nil
+}
+
+// Close unmaps the shared memory and closes the temporary file. If the
+// sharedMem was created with removeOnClose set, the file is also removed.
+func (m *sharedMem) Close() error {
+	if m.region == nil {
+		return nil
+	}
+	if err := m.unmapRegion(); err != nil {
+		return err
+	}
+	if err := m.f.Close(); err != nil {
+		return err
+	}
+	if m.removeOnClose {
+		return os.Remove(m.f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuzz
+
+import (
+	"encoding/json"
+	"fmt"
+	"internal/unsafeheader"
+	"io"
+	"unsafe"
+)
+
+// workerComm holds the communication channels between a coordinator and a
+// worker process. fuzzIn and fuzzOut carry call and response messages;
+// mem is the shared memory region, created by the coordinator and inherited
+// by the worker, used to pass fuzz inputs and outputs without copying them
+// through the pipe on every call.
+type workerComm struct {
+	fuzzIn  io.Writer
+	fuzzOut io.Reader
+	mem     *sharedMem
+}
+
+// call is a message sent from the coordinator to a worker asking it to
+// perform some action. Exactly one field should be set.
+type call struct {
+	Resize *resizeArgs
+}
+
+// response is a message sent from a worker back to the coordinator. Exactly
+// one field should be set, corresponding to the call that produced it.
+type response struct {
+	Resize *resizeResponse
+}
+
+// resizeArgs asks the worker to unmap its view of the coordinator's shared
+// memory file and remap it at a larger size. The coordinator sends this
+// after it has already grown the file with (*sharedMem).resize; the worker
+// only needs to redo its own mapping of the same, now-larger, file.
+type resizeArgs struct {
+	NewCap int
+}
+
+// resizeResponse reports the result of a resizeArgs call.
+type resizeResponse struct {
+	Err string
+}
+
+// workerClient is used by the coordinator to send calls to a worker process
+// and read back its responses.
+type workerClient struct {
+	comm workerComm
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func newWorkerClient(comm workerComm) *workerClient {
+	return &workerClient{
+		comm: comm,
+		enc:  json.NewEncoder(comm.fuzzIn),
+		dec:  json.NewDecoder(comm.fuzzOut),
+	}
+}
+
+func (wc *workerClient) roundTrip(c call) (response, error) {
+	if err := wc.enc.Encode(c); err != nil {
+		return response{}, fmt.Errorf("writing worker call: %w", err)
+	}
+	var resp response
+	if err := wc.dec.Decode(&resp); err != nil {
+		return response{}, fmt.Errorf("reading worker response: %w", err)
+	}
+	return resp, nil
+}
+
+// resizeMem grows the coordinator's shared memory to hold a value of at
+// least newCap bytes, then tells the worker to drop its mapping of the old,
+// smaller file and remap the same file at the new size before the next
+// fuzz call. The worker must not be in the middle of a fuzz call when this
+// is sent, since it can't safely remap memory the coordinator is about to
+// write a new input into.
+func (wc *workerClient) resizeMem(newCap int) error {
+	if err := wc.comm.mem.resize(newCap); err != nil {
+		return err
+	}
+	resp, err := wc.roundTrip(call{Resize: &resizeArgs{NewCap: newCap}})
+	if err != nil {
+		return err
+	}
+	if resp.Resize == nil {
+		return fmt.Errorf("resize call: unexpected response")
+	}
+	if resp.Resize.Err != "" {
+		return fmt.Errorf("worker failed to resize shared memory: %s", resp.Resize.Err)
+	}
+	return nil
+}
+
+// recoverCrash inspects shared memory after the worker process has died
+// unexpectedly (for example, SIGKILL or an OOM kill) to determine whether
+// the value stored there is the input that caused the crash, as opposed to
+// a partially written next input that was in flight when the worker died.
+// The caller should restart the worker before calling this again, and
+// should fall back to the last input it independently knows was good if ok
+// is false.
+func (wc *workerClient) recoverCrash() (value []byte, writerPID int32, ok bool) {
+	return wc.comm.mem.recover()
+}
+
+// workerServer runs in the worker process, reading calls sent by a
+// workerClient and dispatching them.
+type workerServer struct {
+	comm workerComm
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// newWorkerServer validates the header of the shared memory inherited from
+// the coordinator and aliases the worker's coverage counter table onto it
+// before returning, so that a worker built with a different counter table
+// layout than the coordinator expects is rejected immediately instead of
+// corrupting the counters region.
+func newWorkerServer(comm workerComm) (*workerServer, error) {
+	if err := comm.mem.checkHeader(); err != nil {
+		return nil, err
+	}
+	ws := &workerServer{
+		comm: comm,
+		enc:  json.NewEncoder(comm.fuzzIn),
+		dec:  json.NewDecoder(comm.fuzzOut),
+	}
+	if err := ws.aliasCounters(); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// aliasCounters points the process's coverage counter table (_counterTab,
+// see counters_supported.go) at the counters region of shared memory, so
+// the writes the compiler's instrumentation makes as the fuzz function
+// runs land directly where the coordinator can read them, with no copy or
+// RPC per call.
+func (ws *workerServer) aliasCounters() error {
+	counters := ws.comm.mem.counters()
+	if len(counters) != len(_counterTab) {
+		return fmt.Errorf("worker's coverage counter table has %d entries, but shared memory reserves %d; binary mismatch with coordinator?", len(_counterTab), len(counters))
+	}
+	if len(counters) == 0 {
+		return nil
+	}
+	*(*unsafeheader.Slice)(unsafe.Pointer(&_counterTab)) = unsafeheader.Slice{
+		Data: unsafe.Pointer(&counters[0]),
+		Len:  len(counters),
+		Cap:  len(counters),
+	}
+	return nil
+}
+
+// serve handles calls from the coordinator until the pipe is closed.
+func (ws *workerServer) serve() error {
+	for {
+		var c call
+		if err := ws.dec.Decode(&c); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("reading coordinator call: %w", err)
+		}
+
+		var resp response
+		switch {
+		case c.Resize != nil:
+			resp.Resize = &resizeResponse{}
+			if err := ws.resize(c.Resize.NewCap); err != nil {
+				resp.Resize.Err = err.Error()
+			}
+		default:
+			return fmt.Errorf("received call with no arguments set")
+		}
+
+		if err := ws.enc.Encode(resp); err != nil {
+			return fmt.Errorf("writing worker response: %w", err)
+		}
+	}
+}
+
+// resize remaps the worker's view of shared memory at the new size. The
+// coordinator has already truncated the underlying file to newCap's size by
+// the time this is called; the worker only needs to unmap and remap its
+// own view of it, then re-point _counterTab at the counters region, which
+// has moved.
+func (ws *workerServer) resize(newCap int) error {
+	m := ws.comm.mem
+	newSize, err := sharedMemSize(newCap, m.header().counterLen)
+	if err != nil {
+		return err
+	}
+	if newSize <= len(m.region) {
+		return nil
+	}
+	if err := m.unmapRegion(); err != nil {
+		return err
+	}
+	if err := m.mapRegion(newSize); err != nil {
+		return err
+	}
+	return ws.aliasCounters()
+}